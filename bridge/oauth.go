@@ -0,0 +1,290 @@
+package bridge
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// oauthStateTTL is how long an unused state token from loginOAuthStart
+// stays valid before the callback rejects it.
+const oauthStateTTL = 10 * time.Minute
+
+// DiscordOAuthConfig holds the bridge.discord_oauth config block needed for
+// the "Login with Discord" flow. ClientID being empty means OAuth login is
+// disabled.
+type DiscordOAuthConfig struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RedirectURI  string `yaml:"redirect_uri"`
+}
+
+// OAuthToken is the subset of Discord's OAuth2 token response that's worth
+// persisting so the bridge can refresh it later.
+type OAuthToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// oauthState binds the random state tokens handed out by loginOAuthStart to
+// the Matrix user that started the flow, and does the Discord-side token
+// exchange on the caller's behalf.
+type oauthState struct {
+	config DiscordOAuthConfig
+
+	mu      sync.Mutex
+	pending map[string]pendingOAuth
+}
+
+type pendingOAuth struct {
+	mxid    id.UserID
+	expires time.Time
+}
+
+func newOAuthState(config DiscordOAuthConfig) *oauthState {
+	return &oauthState{
+		config:  config,
+		pending: make(map[string]pendingOAuth),
+	}
+}
+
+func (o *oauthState) newState(mxid id.UserID) string {
+	var buf [20]byte
+	_, _ = rand.Read(buf[:])
+	state := hex.EncodeToString(buf[:])
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for key, entry := range o.pending {
+		if time.Now().After(entry.expires) {
+			delete(o.pending, key)
+		}
+	}
+
+	o.pending[state] = pendingOAuth{mxid: mxid, expires: time.Now().Add(oauthStateTTL)}
+
+	return state
+}
+
+func (o *oauthState) popState(state string) (id.UserID, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entry, ok := o.pending[state]
+	if !ok {
+		return "", false
+	}
+
+	delete(o.pending, state)
+
+	if time.Now().After(entry.expires) {
+		return "", false
+	}
+
+	return entry.mxid, true
+}
+
+func (o *oauthState) exchangeCode(ctx context.Context, code string) (*OAuthToken, error) {
+	return o.tokenRequest(ctx, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {o.config.RedirectURI},
+	})
+}
+
+func (o *oauthState) refresh(ctx context.Context, refreshToken string) (*OAuthToken, error) {
+	return o.tokenRequest(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+}
+
+func (o *oauthState) tokenRequest(ctx context.Context, form url.Values) (*OAuthToken, error) {
+	form.Set("client_id", o.config.ClientID)
+	form.Set("client_secret", o.config.ClientSecret)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://discord.com/api/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discord returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %w", err)
+	}
+
+	return &OAuthToken{
+		AccessToken:  body.AccessToken,
+		RefreshToken: body.RefreshToken,
+		ExpiresAt:    time.Now().Add(time.Duration(body.ExpiresIn) * time.Second),
+	}, nil
+}
+
+func (o *oauthState) fetchUserID(ctx context.Context, accessToken string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://discord.com/api/users/@me", nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("discord returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		ID string `json:"id"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode user response: %w", err)
+	}
+
+	return body.ID, nil
+}
+
+// refreshMargin is how long before expiry a token is refreshed.
+const refreshMargin = 5 * time.Minute
+
+// refreshRetryBackoff is how long to wait before retrying a refresh that
+// failed transiently (network blip, Discord hiccup), so one failed attempt
+// doesn't permanently drop the user.
+const refreshRetryBackoff = 30 * time.Second
+
+// oauthRefresher keeps every OAuth-logged-in User's token fresh by waking up
+// shortly before each one expires and exchanging the refresh token.
+type oauthRefresher struct {
+	bridge *Bridge
+	oauth  *oauthState
+
+	mu      sync.Mutex
+	watched map[id.UserID]chan struct{}
+}
+
+func newOAuthRefresher(bridge *Bridge, oauth *oauthState) *oauthRefresher {
+	return &oauthRefresher{
+		bridge:  bridge,
+		oauth:   oauth,
+		watched: make(map[id.UserID]chan struct{}),
+	}
+}
+
+// watch starts (or restarts) the background refresh goroutine for a user
+// that just logged in via OAuth.
+func (r *oauthRefresher) watch(user *User) {
+	r.mu.Lock()
+	if stop, ok := r.watched[user.MXID]; ok {
+		close(stop)
+	}
+	stop := make(chan struct{})
+	r.watched[user.MXID] = stop
+	r.mu.Unlock()
+
+	go r.loop(user, stop)
+}
+
+// watchExisting re-arms the refresh goroutine for every user who already
+// has an OAuth token persisted from before this restart. Without this,
+// only users who logged in (or re-logged in) after the restart would ever
+// get refreshed.
+func (r *oauthRefresher) watchExisting() {
+	for _, user := range r.bridge.GetAllUsers() {
+		user.Lock()
+		hasToken := user.OAuthToken != nil
+		user.Unlock()
+
+		if hasToken {
+			r.watch(user)
+		}
+	}
+}
+
+// getToken reads user.OAuthToken under the user's own lock, since
+// loginOAuthCallback writes it from a different goroutine.
+func getToken(user *User) *OAuthToken {
+	user.Lock()
+	defer user.Unlock()
+
+	return user.OAuthToken
+}
+
+// setToken writes user.OAuthToken under the user's own lock.
+func setToken(user *User, token *OAuthToken) {
+	user.Lock()
+	user.OAuthToken = token
+	user.Unlock()
+
+	user.Update()
+}
+
+func (r *oauthRefresher) loop(user *User, stop chan struct{}) {
+	for {
+		token := getToken(user)
+		if token == nil {
+			return
+		}
+
+		wait := time.Until(token.ExpiresAt) - refreshMargin
+		if wait < 0 {
+			wait = 0
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		refreshed, err := r.oauth.refresh(ctx, token.RefreshToken)
+		cancel()
+
+		if err != nil {
+			user.log.Warnfln("Failed to refresh OAuth token, retrying in %s: %v", refreshRetryBackoff, err)
+
+			select {
+			case <-time.After(refreshRetryBackoff):
+			case <-stop:
+				return
+			}
+
+			continue
+		}
+
+		setToken(user, refreshed)
+	}
+}
@@ -8,13 +8,16 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	log "maunium.net/go/maulogger/v2"
 
+	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-discord/remoteauth"
@@ -27,14 +30,23 @@ const (
 type ProvisioningAPI struct {
 	bridge *Bridge
 	log    log.Logger
+	oauth  *oauthState
 }
 
 func newProvisioningAPI(bridge *Bridge) *ProvisioningAPI {
+	oauth := newOAuthState(bridge.Config.Bridge.DiscordOAuth)
+
 	p := &ProvisioningAPI{
 		bridge: bridge,
 		log:    bridge.log.Sub("Provisioning"),
+		oauth:  oauth,
 	}
 
+	// Re-arm the refresh goroutine for any user who was already logged in
+	// via OAuth before this restart, not just ones that log in from here on.
+	bridge.oauthRefresher = newOAuthRefresher(bridge, oauth)
+	bridge.oauthRefresher.watchExisting()
+
 	prefix := bridge.Config.Appservice.Provisioning.Prefix
 
 	p.log.Debugln("Enabling provisioning API at", prefix)
@@ -46,6 +58,8 @@ func newProvisioningAPI(bridge *Bridge) *ProvisioningAPI {
 	r.HandleFunc("/disconnect", p.disconnect).Methods(http.MethodPost)
 	r.HandleFunc("/ping", p.ping).Methods(http.MethodGet)
 	r.HandleFunc("/login", p.login).Methods(http.MethodGet)
+	r.HandleFunc("/login/token", p.loginToken).Methods(http.MethodPost)
+	r.HandleFunc("/login/oauth/start", p.loginOAuthStart).Methods(http.MethodGet)
 	r.HandleFunc("/logout", p.logout).Methods(http.MethodPost)
 	r.HandleFunc("/reconnect", p.reconnect).Methods(http.MethodPost)
 
@@ -55,6 +69,24 @@ func newProvisioningAPI(bridge *Bridge) *ProvisioningAPI {
 	r.HandleFunc("/guilds/{guildID}/unbridge", p.guildsUnbridge).Methods(http.MethodPost)
 	r.HandleFunc("/guilds/{guildID}/joinentire", p.guildsJoinEntire).Methods(http.MethodPost)
 
+	// Setup the DM/channel endpoints
+	r.HandleFunc("/channels", p.channelsList).Methods(http.MethodGet)
+	r.HandleFunc("/channels/{channelID}/bridge", p.channelsBridge).Methods(http.MethodPost)
+	r.HandleFunc("/channels/{channelID}/unbridge", p.channelsUnbridge).Methods(http.MethodPost)
+	r.HandleFunc("/dms/{userID}/open", p.dmsOpen).Methods(http.MethodPost)
+
+	// The bridge state endpoint is polled by the homeserver (e.g. Beeper),
+	// not the logged-in Matrix user, so it's authorized via the appservice
+	// token rather than the provisioning shared secret.
+	bsRouter := bridge.as.Router.PathPrefix(prefix).Subrouter()
+	bsRouter.Use(p.asTokenMiddleware)
+	bsRouter.HandleFunc("/bridge_state", p.BridgeStatePing).Methods(http.MethodGet)
+
+	// The OAuth callback is hit by Discord redirecting the user's browser, so
+	// it can't carry the provisioning shared secret; it's authorized by the
+	// random state token minted in loginOAuthStart instead.
+	bridge.as.Router.HandleFunc(prefix+"/login/oauth/callback", p.loginOAuthCallback).Methods(http.MethodGet)
+
 	return p
 }
 
@@ -138,6 +170,40 @@ func (p *ProvisioningAPI) authMiddleware(h http.Handler) http.Handler {
 	})
 }
 
+// asTokenMiddleware authorizes requests using the appservice's own as_token
+// instead of the provisioning shared secret, for endpoints that are polled
+// by the homeserver rather than driven by a logged-in Matrix user.
+func (p *ProvisioningAPI) asTokenMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") {
+			auth = auth[len("Bearer "):]
+		}
+
+		if auth != p.bridge.Config.Appservice.ASToken {
+			jsonResponse(w, http.StatusForbidden, Error{
+				Error:   "Invalid auth token",
+				ErrCode: "M_FORBIDDEN",
+			})
+
+			return
+		}
+
+		userID := r.URL.Query().Get("user_id")
+		user := p.bridge.GetUserByMXID(id.UserID(userID))
+		if user == nil {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   "Invalid or missing user_id",
+				ErrCode: "M_BAD_REQUEST",
+			})
+
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "user", user)))
+	})
+}
+
 // websocket upgrader
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
@@ -165,6 +231,8 @@ func (p *ProvisioningAPI) disconnect(w http.ResponseWriter, r *http.Request) {
 			ErrCode: "failed to disconnect",
 		})
 	} else {
+		user.sendBridgeState(user.getBridgeState())
+
 		jsonResponse(w, http.StatusOK, Response{
 			Success: true,
 			Status:  "Disconnected from Discord",
@@ -206,6 +274,21 @@ func (p *ProvisioningAPI) ping(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, http.StatusOK, resp)
 }
 
+// BridgeStatePing returns the current status.GlobalBridgeState for the user,
+// for homeservers (e.g. Beeper) that poll instead of receiving pushes.
+func (p *ProvisioningAPI) BridgeStatePing(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	globalState := status.GlobalBridgeState{
+		BridgeState: user.getBridgeState(),
+		RemoteStates: map[string]status.BridgeState{
+			string(user.ID): user.getBridgeState(),
+		},
+	}
+
+	jsonResponse(w, http.StatusOK, &globalState)
+}
+
 func (p *ProvisioningAPI) logout(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(*User)
 	force := strings.ToLower(r.URL.Query().Get("force")) != "false"
@@ -246,9 +329,32 @@ func (p *ProvisioningAPI) logout(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	user.sendBridgeState(user.getBridgeState())
+
 	jsonResponse(w, http.StatusOK, Response{true, "Logged out successfully."})
 }
 
+// loginEvent is one frame of the discriminated event stream sent over the
+// /login websocket. Only the fields relevant to Type are populated.
+type loginEvent struct {
+	Type string `json:"type"`
+
+	Code    string `json:"code,omitempty"`
+	Timeout int    `json:"timeout,omitempty"`
+
+	UserID string `json:"user_id,omitempty"`
+	ID     string `json:"id,omitempty"`
+
+	ErrCode string `json:"errcode,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// loginCommand is the shape of frames the client may send back, currently
+// just the cancel request.
+type loginCommand struct {
+	Type string `json:"type"`
+}
+
 func (p *ProvisioningAPI) login(w http.ResponseWriter, r *http.Request) {
 	userID := r.URL.Query().Get("user_id")
 	user := p.bridge.GetUserByMXID(id.UserID(userID))
@@ -266,29 +372,49 @@ func (p *ProvisioningAPI) login(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	go func() {
-		// Read everything so SetCloseHandler() works
-		for {
-			_, _, err := c.ReadMessage()
-			if err != nil {
-				break
-			}
-		}
-	}()
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	serverCancel := make(chan struct{})
+
+	var cancelOnce sync.Once
+	var cancelledByClient bool
+
+	stop := func(clientInitiated bool) {
+		cancelOnce.Do(func() {
+			cancelledByClient = clientInitiated
+			close(serverCancel)
+			cancelCtx()
+		})
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
 	c.SetCloseHandler(func(code int, text string) error {
 		user.log.Debugfln("Login websocket closed (%d), cancelling login", code)
 
-		cancel()
+		stop(false)
 
 		return nil
 	})
 
+	go func() {
+		for {
+			var cmd loginCommand
+			if err := c.ReadJSON(&cmd); err != nil {
+				break
+			}
+
+			if cmd.Type == "cancel" {
+				user.log.Debugln("Login cancelled by client")
+				stop(true)
+
+				return
+			}
+		}
+	}()
+
 	if user.LoggedIn() {
-		c.WriteJSON(Error{
-			Error:   "You're already logged into Discord",
+		c.WriteJSON(loginEvent{
+			Type:    "error",
 			ErrCode: "already logged in",
+			Error:   "You're already logged into Discord",
 		})
 
 		return
@@ -298,39 +424,62 @@ func (p *ProvisioningAPI) login(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		user.log.Errorf("Failed to log in from provisioning API:", err)
 
-		c.WriteJSON(Error{
-			Error:   "Failed to connect to Discord",
+		c.WriteJSON(loginEvent{
+			Type:    "error",
 			ErrCode: "connection error",
+			Error:   "Failed to connect to Discord",
 		})
+
+		return
 	}
 
+	events := make(chan remoteauth.Event)
 	qrChan := make(chan string)
 	doneChan := make(chan struct{})
 
 	user.log.Debugln("Started login via provisioning API")
 
-	err = client.Dial(ctx, qrChan, doneChan)
+	err = client.Dial(ctx, events, qrChan, doneChan, serverCancel)
 	if err != nil {
+		close(events)
 		close(qrChan)
 		close(doneChan)
 	}
 
 	for {
 		select {
+		case event, ok := <-events:
+			if !ok {
+				continue
+			}
+
+			switch event.Type {
+			case remoteauth.EventFingerprint:
+				// Also delivered on qrChan below; the events frame exists so
+				// clients that care about handshake progress (vs. just the
+				// QR code itself) can distinguish this step explicitly.
+			case remoteauth.EventUserInfo:
+				c.WriteJSON(loginEvent{Type: "scanned"})
+			case remoteauth.EventToken:
+				c.WriteJSON(loginEvent{Type: "paired", UserID: event.UserID})
+			}
 		case qrCode, ok := <-qrChan:
 			if !ok {
 				continue
 			}
-			c.WriteJSON(map[string]interface{}{
-				"code":    qrCode,
-				"timeout": 120, // TODO: move this to the library or something
+
+			c.WriteJSON(loginEvent{
+				Type:    "qr",
+				Code:    qrCode,
+				Timeout: 120, // TODO: move this to the library or something
 			})
 		case <-doneChan:
 			discordUser, err := client.Result()
 			if err != nil {
-				c.WriteJSON(Error{
-					Error:   "Failed to connect to Discord",
+				c.WriteJSON(loginEvent{
+					Type:    "error",
 					ErrCode: "connection error",
+					Error:   "Failed to connect to Discord",
 				})
 
 				p.log.Errorfln("failed to login via qrcode:", err)
@@ -342,9 +491,10 @@ func (p *ProvisioningAPI) login(w http.ResponseWriter, r *http.Request) {
 			user.Update()
 
 			if err := user.Login(discordUser.Token); err != nil {
-				c.WriteJSON(Error{
-					Error:   "Failed to connect to Discord",
+				c.WriteJSON(loginEvent{
+					Type:    "error",
 					ErrCode: "connection error",
+					Error:   "Failed to connect to Discord",
 				})
 
 				p.log.Errorfln("failed to login via qrcode:", err)
@@ -352,18 +502,178 @@ func (p *ProvisioningAPI) login(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			c.WriteJSON(map[string]interface{}{
-				"success": true,
-				"id":      user.ID,
-			})
+			user.registerBridgeStateHandlers()
+			user.sendBridgeState(user.getBridgeState())
+
+			c.WriteJSON(loginEvent{Type: "success", ID: user.ID})
 
 			return
 		case <-ctx.Done():
+			select {
+			case <-doneChan:
+			default:
+				if cancelledByClient {
+					c.WriteJSON(loginEvent{Type: "cancelled"})
+				} else {
+					c.WriteJSON(loginEvent{Type: "timeout"})
+				}
+			}
+
 			return
 		}
 	}
 }
 
+// loginToken lets headless clients (that can't speak the login websocket
+// protocol) log in by handing over an already-obtained Discord token
+// directly, skipping the QR/remote-auth dance entirely.
+func (p *ProvisioningAPI) loginToken(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	if user.LoggedIn() {
+		jsonResponse(w, http.StatusConflict, Error{
+			Error:   "You're already logged into Discord",
+			ErrCode: "already logged in",
+		})
+
+		return
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Invalid JSON body, expected a 'token' field",
+			ErrCode: "M_BAD_JSON",
+		})
+
+		return
+	}
+
+	if err := user.Login(body.Token); err != nil {
+		user.log.Warnln("Error while logging in with a raw token:", err)
+
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   fmt.Sprintf("Failed to connect to Discord: %v", err),
+			ErrCode: "connection error",
+		})
+
+		return
+	}
+
+	user.registerBridgeStateHandlers()
+	user.sendBridgeState(user.getBridgeState())
+
+	jsonResponse(w, http.StatusOK, Response{
+		Success: true,
+		Status:  "Logged into Discord",
+	})
+}
+
+// loginOAuthStart begins the "Login with Discord" OAuth2 flow: it mints a
+// state token bound to the requesting Matrix user and redirects the browser
+// to Discord's authorize page. This is a bot-account-friendly alternative to
+// scraping the QR remote-auth flow.
+func (p *ProvisioningAPI) loginOAuthStart(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	cfg := p.bridge.Config.Bridge.DiscordOAuth
+	if cfg.ClientID == "" {
+		jsonResponse(w, http.StatusNotImplemented, Error{
+			Error:   "OAuth login is not configured on this bridge",
+			ErrCode: "M_UNRECOGNIZED",
+		})
+
+		return
+	}
+
+	state := p.oauth.newState(user.MXID)
+
+	authorizeURL := fmt.Sprintf(
+		"https://discord.com/api/oauth2/authorize?client_id=%s&redirect_uri=%s&response_type=code&scope=%s&state=%s",
+		url.QueryEscape(cfg.ClientID),
+		url.QueryEscape(cfg.RedirectURI),
+		url.QueryEscape("identify guilds messages.read"),
+		url.QueryEscape(state),
+	)
+
+	http.Redirect(w, r, authorizeURL, http.StatusFound)
+}
+
+// loginOAuthCallback exchanges the authorization code Discord redirected
+// back with for an access/refresh token pair and resolves the Discord user
+// ID for the Matrix user bound to the state token.
+//
+// Note that an OAuth2 access token obtained this way only grants whatever
+// the authorized scopes cover over the REST API (here, reading the user's
+// identity/guilds/messages) - it cannot open Discord's gateway. So unlike
+// the QR and /login/token flows, this does not call user.Login: it links
+// the Discord account for identification, and a real session (QR pairing
+// or a raw user token) is still required before anything gets bridged.
+func (p *ProvisioningAPI) loginOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	mxid, ok := p.oauth.popState(query.Get("state"))
+	if !ok {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Unknown or expired OAuth state",
+			ErrCode: "M_BAD_STATE",
+		})
+
+		return
+	}
+
+	user := p.bridge.GetUserByMXID(mxid)
+
+	if errCode := query.Get("error"); errCode != "" {
+		jsonResponse(w, http.StatusBadGateway, Error{
+			Error:   "Discord returned an OAuth error: " + errCode,
+			ErrCode: "M_BAD_GATEWAY",
+		})
+
+		return
+	}
+
+	token, err := p.oauth.exchangeCode(r.Context(), query.Get("code"))
+	if err != nil {
+		user.log.Warnln("Failed to exchange OAuth code:", err)
+
+		jsonResponse(w, http.StatusBadGateway, Error{
+			Error:   "Failed to exchange OAuth code with Discord",
+			ErrCode: "M_BAD_GATEWAY",
+		})
+
+		return
+	}
+
+	discordUserID, err := p.oauth.fetchUserID(r.Context(), token.AccessToken)
+	if err != nil {
+		user.log.Warnln("Failed to fetch Discord user id:", err)
+
+		jsonResponse(w, http.StatusBadGateway, Error{
+			Error:   "Failed to fetch Discord user info",
+			ErrCode: "M_BAD_GATEWAY",
+		})
+
+		return
+	}
+
+	user.ID = discordUserID
+	user.Update()
+
+	setToken(user, token)
+	p.bridge.oauthRefresher.watch(user)
+
+	user.sendBridgeState(user.getBridgeState())
+
+	jsonResponse(w, http.StatusOK, Response{
+		Success: true,
+		Status:  "Linked Discord account via OAuth. Use /login or /login/token to start bridging.",
+	})
+}
+
 func (p *ProvisioningAPI) reconnect(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value("user").(*User)
 
@@ -382,6 +692,9 @@ func (p *ProvisioningAPI) reconnect(w http.ResponseWriter, r *http.Request) {
 			ErrCode: "failed to connect",
 		})
 	} else {
+		user.registerBridgeStateHandlers()
+		user.sendBridgeState(user.getBridgeState())
+
 		jsonResponse(w, http.StatusOK, Response{
 			Success: true,
 			Status:  "Connected to Discord",
@@ -415,7 +728,9 @@ func (p *ProvisioningAPI) guildsBridge(w http.ResponseWriter, r *http.Request) {
 
 	guildID, _ := mux.Vars(r)["guildID"]
 
-	if err := user.bridgeGuild(guildID, false); err != nil {
+	// bridgeGuild issues its REST calls through the rate-limited discord/rest
+	// client, so pass the request context through for cancellation.
+	if err := user.bridgeGuild(r.Context(), guildID, false); err != nil {
 		jsonResponse(w, http.StatusNotFound, Error{
 			Error:   err.Error(),
 			ErrCode: "M_NOT_FOUND",
@@ -447,7 +762,10 @@ func (p *ProvisioningAPI) guildsJoinEntire(w http.ResponseWriter, r *http.Reques
 
 	guildID, _ := mux.Vars(r)["guildID"]
 
-	if err := user.bridgeGuild(guildID, true); err != nil {
+	// Joining every channel in a large guild can issue dozens of requests in
+	// quick succession; bridgeGuild routes them through the rate-limited
+	// discord/rest client so this doesn't get the user hard-limited.
+	if err := user.bridgeGuild(r.Context(), guildID, true); err != nil {
 		jsonResponse(w, http.StatusNotFound, Error{
 			Error:   err.Error(),
 			ErrCode: "M_NOT_FOUND",
@@ -456,3 +774,95 @@ func (p *ProvisioningAPI) guildsJoinEntire(w http.ResponseWriter, r *http.Reques
 		w.WriteHeader(http.StatusCreated)
 	}
 }
+
+func (p *ProvisioningAPI) channelsList(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	channels, err := user.getBridgeableChannels()
+	if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   err.Error(),
+			ErrCode: "M_UNKNOWN",
+		})
+
+		return
+	}
+
+	data := make([]map[string]interface{}, len(channels))
+	for idx, channel := range channels {
+		entry := map[string]interface{}{
+			"id":   channel.ChannelID,
+			"name": channel.Name,
+			"type": channel.Type.String(),
+		}
+
+		if channel.GuildID != "" {
+			entry["guild_id"] = channel.GuildID
+		}
+
+		if channel.Portal != nil {
+			entry["room_id"] = channel.Portal.MXID
+		}
+
+		data[idx] = entry
+	}
+
+	jsonResponse(w, http.StatusOK, data)
+}
+
+func (p *ProvisioningAPI) channelsBridge(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	channelID, _ := mux.Vars(r)["channelID"]
+
+	portal, err := user.bridgeChannel(r.Context(), channelID)
+	if err != nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   err.Error(),
+			ErrCode: "M_NOT_FOUND",
+		})
+
+		return
+	}
+
+	jsonResponse(w, http.StatusCreated, map[string]interface{}{
+		"room_id": portal.MXID,
+	})
+}
+
+func (p *ProvisioningAPI) channelsUnbridge(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	channelID, _ := mux.Vars(r)["channelID"]
+
+	if err := user.unbridgeChannel(channelID); err != nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   err.Error(),
+			ErrCode: "M_NOT_FOUND",
+		})
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *ProvisioningAPI) dmsOpen(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	discordUserID, _ := mux.Vars(r)["userID"]
+
+	portal, err := user.openDM(discordUserID)
+	if err != nil {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   err.Error(),
+			ErrCode: "M_NOT_FOUND",
+		})
+
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"room_id": portal.MXID,
+	})
+}
@@ -0,0 +1,54 @@
+package bridge
+
+import (
+	"maunium.net/go/mautrix/bridge/status"
+
+	"go.mau.fi/mautrix-discord/bridgestate"
+)
+
+// FillBridgeState fills in the fields that are the same on every state we
+// send for this user, so callers only have to set the state event and
+// error (if any).
+func (user *User) FillBridgeState(state status.BridgeState) status.BridgeState {
+	state.RemoteID = string(user.ID)
+	state.RemoteName = user.Username
+	state.UserID = user.MXID
+
+	return state
+}
+
+// getBridgeState derives the current status.BridgeState from the user's
+// connection/login status, for both the poll (BridgeStatePing) and push
+// (BridgeState.Send) paths.
+func (user *User) getBridgeState() status.BridgeState {
+	if !user.LoggedIn() {
+		return user.FillBridgeState(status.BridgeState{StateEvent: status.StateUnconfigured})
+	}
+
+	if user.Session == nil {
+		return user.FillBridgeState(status.BridgeState{StateEvent: status.StateBadCredentials})
+	}
+
+	if !user.Connected() {
+		return user.FillBridgeState(status.BridgeState{StateEvent: status.StateConnecting})
+	}
+
+	return user.FillBridgeState(status.BridgeState{StateEvent: status.StateConnected})
+}
+
+// bridgeStateQueue lazily builds the push queue for this user on first use,
+// pointing it at the configured bridge.status_endpoint (if any).
+func (user *User) bridgeStateQueue() *bridgestate.Queue {
+	if user.BridgeState == nil {
+		user.BridgeState = bridgestate.NewQueue(user, user.log)
+		user.BridgeState.SetEndpoint(user.bridge.Config.Bridge.StatusEndpoint, user.bridge.Config.Appservice.ASToken)
+	}
+
+	return user.BridgeState
+}
+
+// sendBridgeState pushes the user's current state to the configured
+// bridge.status_endpoint, if any, deduping identical consecutive states.
+func (user *User) sendBridgeState(state status.BridgeState) {
+	user.bridgeStateQueue().Send(state)
+}
@@ -0,0 +1,154 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// ChannelType mirrors the subset of discordgo.ChannelType that the
+// provisioning API exposes to clients, collapsing the various thread types
+// into "thread".
+type ChannelType string
+
+const (
+	ChannelTypeDM      ChannelType = "dm"
+	ChannelTypeGroupDM ChannelType = "group"
+	ChannelTypeText    ChannelType = "text"
+	ChannelTypeVoice   ChannelType = "voice"
+	ChannelTypeThread  ChannelType = "thread"
+	ChannelTypeUnknown ChannelType = "unknown"
+)
+
+func (t ChannelType) String() string {
+	return string(t)
+}
+
+// BridgeableChannel is one row returned from GET /channels: a DM, group DM,
+// guild text/voice channel, or thread that the user could bridge, along
+// with the Matrix room it's already bridged to (if any).
+type BridgeableChannel struct {
+	ChannelID string
+	Name      string
+	Type      ChannelType
+	GuildID   string
+	Portal    *Portal
+}
+
+func discordChannelType(t discordgo.ChannelType) ChannelType {
+	switch t {
+	case discordgo.ChannelTypeDM:
+		return ChannelTypeDM
+	case discordgo.ChannelTypeGroupDM:
+		return ChannelTypeGroupDM
+	case discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildNews:
+		return ChannelTypeText
+	case discordgo.ChannelTypeGuildVoice, discordgo.ChannelTypeGuildStageVoice:
+		return ChannelTypeVoice
+	case discordgo.ChannelTypeGuildPublicThread, discordgo.ChannelTypeGuildPrivateThread, discordgo.ChannelTypeGuildNewsThread:
+		return ChannelTypeThread
+	default:
+		return ChannelTypeUnknown
+	}
+}
+
+// getBridgeableChannels lists every DM, group DM, and guild channel/thread
+// the user's Discord session can see, annotated with the Matrix portal it's
+// already bridged to (if any), for the chat-list style /channels endpoint.
+func (user *User) getBridgeableChannels() ([]*BridgeableChannel, error) {
+	if !user.Connected() {
+		return nil, fmt.Errorf("not connected to discord")
+	}
+
+	discordChannels, err := user.Session.UserChannels()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch channels: %w", err)
+	}
+
+	// UserChannels only returns DMs and group DMs; guild channels and
+	// threads come from the session's cached guild state.
+	user.Session.State.RLock()
+	for _, guild := range user.Session.State.Guilds {
+		discordChannels = append(discordChannels, guild.Channels...)
+		discordChannels = append(discordChannels, guild.Threads...)
+	}
+	user.Session.State.RUnlock()
+
+	channels := make([]*BridgeableChannel, 0, len(discordChannels))
+	for _, channel := range discordChannels {
+		entry := &BridgeableChannel{
+			ChannelID: channel.ID,
+			Name:      channel.Name,
+			Type:      discordChannelType(channel.Type),
+			GuildID:   channel.GuildID,
+		}
+
+		if portal := user.bridge.GetExistingPortalByID(channel.ID); portal != nil {
+			entry.Portal = portal
+		}
+
+		channels = append(channels, entry)
+	}
+
+	return channels, nil
+}
+
+// bridgeChannel creates (or returns the existing) portal for a single
+// channel, without requiring the whole parent guild to be bridged. The
+// channel is fetched through the rate-limited discord/rest client first, so
+// a joinentire's burst of per-channel calls actually gets throttled.
+func (user *User) bridgeChannel(ctx context.Context, channelID string) (*Portal, error) {
+	if !user.Connected() {
+		return nil, fmt.Errorf("not connected to discord")
+	}
+
+	if _, err := user.fetchChannelInfo(ctx, channelID); err != nil {
+		return nil, fmt.Errorf("failed to fetch channel %s: %w", channelID, err)
+	}
+
+	portal := user.bridge.GetPortalByID(channelID)
+
+	if err := portal.CreateMatrixRoom(user); err != nil {
+		return nil, fmt.Errorf("failed to create room for channel %s: %w", channelID, err)
+	}
+
+	return portal, nil
+}
+
+// unbridgeChannel cleans up the Matrix room for a single bridged channel.
+func (user *User) unbridgeChannel(channelID string) error {
+	portal := user.bridge.GetExistingPortalByID(channelID)
+	if portal == nil {
+		return fmt.Errorf("channel %s is not bridged", channelID)
+	}
+
+	portal.Cleanup(false)
+
+	return nil
+}
+
+// openDM locates or creates the DM portal for a Discord user and invites
+// the requesting Matrix user to it, returning the room.
+func (user *User) openDM(discordUserID string) (*Portal, error) {
+	if !user.Connected() {
+		return nil, fmt.Errorf("not connected to discord")
+	}
+
+	channel, err := user.Session.UserChannelCreate(discordUserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DM with %s: %w", discordUserID, err)
+	}
+
+	portal := user.bridge.GetPortalByID(channel.ID)
+
+	if err := portal.CreateMatrixRoom(user); err != nil {
+		return nil, fmt.Errorf("failed to create DM room with %s: %w", discordUserID, err)
+	}
+
+	if err := portal.InviteMatrixUser(user); err != nil {
+		return nil, fmt.Errorf("failed to invite user to DM room: %w", err)
+	}
+
+	return portal, nil
+}
@@ -0,0 +1,22 @@
+package bridge
+
+import "github.com/bwmarrin/discordgo"
+
+// registerBridgeStateHandlers hooks session-level gateway events that should
+// push a bridge state update. Call this once a Session exists, after
+// Connect()/Login() succeeds.
+func (user *User) registerBridgeStateHandlers() {
+	if user.Session == nil {
+		return
+	}
+
+	user.Session.AddHandler(user.onGatewayDisconnect)
+}
+
+// onGatewayDisconnect pushes the user's current (now degraded) bridge state
+// whenever the Discord gateway connection drops, so the status endpoint
+// doesn't keep reporting StateConnected through a network-dropped session.
+func (user *User) onGatewayDisconnect(_ *discordgo.Session, _ *discordgo.Disconnect) {
+	user.log.Debugln("Gateway disconnected, pushing updated bridge state")
+	user.sendBridgeState(user.getBridgeState())
+}
@@ -0,0 +1,135 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/bwmarrin/discordgo"
+
+	"go.mau.fi/mautrix-discord/discord/rest"
+)
+
+// restClient lazily builds the rate-limited REST client for this user's
+// Discord session and reuses it across calls, so bucket state learned from
+// one request's headers actually throttles the next one.
+func (user *User) restClient() *rest.Client {
+	if user.rest == nil {
+		user.rest = rest.New(user.Session.Token, "mautrix-discord/1.0")
+	}
+
+	return user.rest
+}
+
+// bridgeGuild marks a guild as bridged, and when joinEntire is set, also
+// fetches and joins every channel in it. The channel listing and per-channel
+// joins go through the rate-limited discord/rest client so joining a large
+// guild doesn't trip Discord's hard rate limits.
+func (user *User) bridgeGuild(ctx context.Context, guildID string, joinEntire bool) error {
+	guild, ok := user.guilds[guildID]
+	if !ok {
+		return fmt.Errorf("guild %s not found", guildID)
+	}
+
+	guild.Bridge = true
+	user.Update()
+
+	if !joinEntire {
+		return nil
+	}
+
+	channels, err := user.fetchGuildChannels(ctx, guildID)
+	if err != nil {
+		return fmt.Errorf("failed to list channels in guild %s: %w", guildID, err)
+	}
+
+	for _, channel := range channels {
+		if _, err := user.bridgeChannel(ctx, channel.ChannelID); err != nil {
+			user.log.Warnfln("Failed to bridge channel %s while joining guild %s entire: %v", channel.ChannelID, guildID, err)
+		}
+	}
+
+	return nil
+}
+
+// unbridgeGuild removes the guild from the user's bridged set. This is pure
+// local bookkeeping, so it doesn't need the REST client.
+func (user *User) unbridgeGuild(guildID string) error {
+	guild, ok := user.guilds[guildID]
+	if !ok {
+		return fmt.Errorf("guild %s not found", guildID)
+	}
+
+	guild.Bridge = false
+	user.Update()
+
+	return nil
+}
+
+// fetchGuildChannels lists a guild's channels through the rate-limited REST
+// client, so joinentire's burst of channel joins doesn't drain the bucket
+// before it even starts bridging anything.
+func (user *User) fetchGuildChannels(ctx context.Context, guildID string) ([]*BridgeableChannel, error) {
+	path := fmt.Sprintf("/guilds/%s/channels", guildID)
+
+	resp, err := user.restClient().Do(ctx, http.MethodGet, path, map[string]string{"guild_id": guildID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var raw []struct {
+		ID   string                `json:"id"`
+		Name string                `json:"name"`
+		Type discordgo.ChannelType `json:"type"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to decode channel list: %w", err)
+	}
+
+	channels := make([]*BridgeableChannel, len(raw))
+	for i, c := range raw {
+		channels[i] = &BridgeableChannel{
+			ChannelID: c.ID,
+			Name:      c.Name,
+			Type:      discordChannelType(c.Type),
+			GuildID:   guildID,
+		}
+	}
+
+	return channels, nil
+}
+
+// fetchChannelInfo fetches a single channel through the rate-limited REST
+// client. bridgeChannel calls this before creating the Matrix room for it,
+// so the burst of per-channel requests a joinentire produces is actually
+// throttled by the bucket tracker instead of going straight to discordgo.
+func (user *User) fetchChannelInfo(ctx context.Context, channelID string) (*BridgeableChannel, error) {
+	path := fmt.Sprintf("/channels/%s", channelID)
+
+	resp, err := user.restClient().Do(ctx, http.MethodGet, path, map[string]string{"channel_id": channelID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var raw struct {
+		ID      string                `json:"id"`
+		Name    string                `json:"name"`
+		Type    discordgo.ChannelType `json:"type"`
+		GuildID string                `json:"guild_id"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to decode channel: %w", err)
+	}
+
+	return &BridgeableChannel{
+		ChannelID: raw.ID,
+		Name:      raw.Name,
+		Type:      discordChannelType(raw.Type),
+		GuildID:   raw.GuildID,
+	}, nil
+}
@@ -0,0 +1,167 @@
+// Package bridgestate implements a small queue for sending bridge state
+// updates (as defined by maunium.net/go/mautrix/bridge/status) to an
+// optional push endpoint configured by the homeserver/bridge operator.
+package bridgestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/bridge/status"
+)
+
+// Default timing parameters for the retry/backoff loop. These mirror the
+// values used by other Beeper bridges (mautrix-gmessages, mautrix-whatsapp).
+const (
+	MinBackoff = 2 * time.Second
+	MaxBackoff = 60 * time.Second
+	RequestTTL = 15 * time.Second
+)
+
+// Fillable is implemented by the thing that owns a Queue (normally *User)
+// so it can supply the extra fields that go on every outgoing state, such
+// as the remote ID/name.
+type Fillable interface {
+	FillBridgeState(status.BridgeState) status.BridgeState
+}
+
+// Queue delivers bridge state updates to a configurable status endpoint,
+// retrying with capped exponential backoff and deduplicating identical
+// consecutive states so the operator isn't spammed on every event.
+type Queue struct {
+	outgoing chan status.BridgeState
+	url      string
+	asToken  string
+	log      log.Logger
+	owner    Fillable
+
+	lock     sync.Mutex
+	lastSent *status.BridgeState
+}
+
+// NewQueue creates a Queue bound to a single remote (Discord account). The
+// queue is unconfigured (a no-op) until a status endpoint URL is set.
+func NewQueue(owner Fillable, log log.Logger) *Queue {
+	q := &Queue{
+		outgoing: make(chan status.BridgeState, 16),
+		log:      log,
+		owner:    owner,
+	}
+
+	go q.loop()
+
+	return q
+}
+
+// SetEndpoint updates the push destination. Passing an empty URL disables
+// push delivery (the ping endpoint can still be polled directly).
+func (q *Queue) SetEndpoint(url, asToken string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.url = url
+	q.asToken = asToken
+}
+
+// Send enqueues a state for delivery. It never blocks the caller for long:
+// if the queue is full the oldest pending state is dropped in favor of the
+// newest one, since only the current state matters.
+func (q *Queue) Send(state status.BridgeState) {
+	state = q.owner.FillBridgeState(state)
+
+	select {
+	case q.outgoing <- state:
+	default:
+		select {
+		case <-q.outgoing:
+		default:
+		}
+
+		q.outgoing <- state
+	}
+}
+
+func (q *Queue) loop() {
+	for state := range q.outgoing {
+		q.deliver(state)
+	}
+}
+
+func (q *Queue) deliver(state status.BridgeState) {
+	q.lock.Lock()
+	url, asToken := q.url, q.asToken
+	dupe := q.lastSent != nil && q.lastSent.StateEvent == state.StateEvent && q.lastSent.Error == state.Error
+	q.lock.Unlock()
+
+	if url == "" || dupe {
+		return
+	}
+
+	backoff := MinBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := q.send(url, asToken, state)
+		if err == nil {
+			q.lock.Lock()
+			copied := state
+			q.lastSent = &copied
+			q.lock.Unlock()
+
+			return
+		}
+
+		q.log.Warnfln("Failed to send bridge state to %s (attempt %d): %v", url, attempt, err)
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > MaxBackoff {
+			backoff = MaxBackoff
+		}
+	}
+}
+
+func (q *Queue) send(url, asToken string, state status.BridgeState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTTL)
+	defer cancel()
+
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal bridge state: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+asToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Unconfigured returns the default "remote not logged in yet" state, used
+// before the first real transition has been observed.
+func Unconfigured(remoteID string) status.BridgeState {
+	return status.BridgeState{
+		StateEvent: status.StateUnconfigured,
+		RemoteID:   remoteID,
+	}
+}
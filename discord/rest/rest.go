@@ -0,0 +1,277 @@
+// Package rest implements an outbound HTTP client for Discord's REST API
+// that tracks per-route rate-limit buckets. User sends its provisioning
+// guild and channel fetches through it, so bulk operations like joining
+// every channel in a guild stop tripping Discord's hard rate limits. The
+// discordgo session's own REST calls do not go through this client.
+package rest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	baseURL = "https://discord.com/api/v10"
+
+	maxRetries  = 5
+	baseBackoff = 500 * time.Millisecond
+	maxBackoff  = 30 * time.Second
+)
+
+var (
+	retriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "discord_rest_retries_total",
+		Help: "Number of requests to the Discord REST API that were retried after a 5xx response.",
+	})
+	rateLimitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "discord_rest_rate_limits_total",
+		Help: "Number of 429 responses received from the Discord REST API, by scope.",
+	}, []string{"scope"})
+)
+
+// snowflake matches a path segment that looks like a Discord ID, and
+// majorParts names the major rate-limit parameters whose values must stay in
+// the route key verbatim; every other path segment that looks like a
+// snowflake ID is templated out so e.g. two different messages share one
+// bucket.
+var (
+	snowflake  = regexp.MustCompile(`^\d{15,20}$`)
+	majorParts = map[string]bool{"guild_id": true, "channel_id": true, "webhook_id": true}
+)
+
+// bucket tracks the rate-limit state Discord reports for one route key.
+type bucket struct {
+	mu        sync.Mutex
+	id        string
+	remaining int
+	reset     time.Time
+}
+
+// Client is a rate-limit-aware HTTP client for the Discord REST API. It is
+// safe for concurrent use. Each User keeps one Client for its
+// provisioning-driven guild and channel fetches; requests made through the
+// discordgo session bypass it and are not counted against its buckets.
+type Client struct {
+	http      *http.Client
+	token     string
+	userAgent string
+
+	bucketsMu sync.Mutex
+	buckets   map[string]*bucket // X-RateLimit-Bucket id -> bucket
+	byRoute   map[string]*bucket // route key -> bucket, populated once a response has revealed its bucket id
+
+	globalMu   sync.Mutex
+	globalGate time.Time
+}
+
+// New creates a Client that authorizes requests with the given token
+// (already in the form Discord expects, e.g. "Bot ..." or a user token).
+func New(token, userAgent string) *Client {
+	return &Client{
+		http:      &http.Client{},
+		token:     token,
+		userAgent: userAgent,
+		buckets:   make(map[string]*bucket),
+		byRoute:   make(map[string]*bucket),
+	}
+}
+
+// routeKey builds the bucket key for a request: the method plus the path
+// with major params preserved and every other ID segment templated out.
+func routeKey(method, path string, params map[string]string) string {
+	major := make(map[string]bool)
+	for name, value := range params {
+		if majorParts[name] {
+			major[value] = true
+		}
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if snowflake.MatchString(segment) && !major[segment] {
+			segments[i] = "{id}"
+		}
+	}
+
+	return method + " " + strings.Join(segments, "/")
+}
+
+// Do issues a rate-limit-aware request to path (relative to the Discord API
+// base URL), which must already have its IDs filled in. params maps parameter
+// names (e.g. "guild_id") to the raw ID values in path, and is used only to
+// build the bucket route key.
+func (c *Client) Do(ctx context.Context, method, path string, params map[string]string, body []byte) (*http.Response, error) {
+	key := routeKey(method, path, params)
+
+	var lastErr error
+
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if err := c.waitForBucket(ctx, key); err != nil {
+			return nil, err
+		}
+
+		if err := c.waitForGlobal(ctx); err != nil {
+			return nil, err
+		}
+
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, baseURL+path, reqBody)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Authorization", c.token)
+		req.Header.Set("User-Agent", c.userAgent)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		c.updateBucket(key, resp.Header)
+
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			rateLimitsTotal.WithLabelValues(resp.Header.Get("X-RateLimit-Scope")).Inc()
+
+			retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+
+			if resp.Header.Get("X-RateLimit-Scope") == "global" {
+				c.setGlobalGate(retryAfter)
+			}
+
+			if err := sleep(ctx, retryAfter); err != nil {
+				return nil, err
+			}
+
+			lastErr = fmt.Errorf("rate limited")
+
+			continue
+		case resp.StatusCode >= 500:
+			resp.Body.Close()
+			retriesTotal.Inc()
+
+			backoff := time.Duration(math.Min(float64(maxBackoff), float64(baseBackoff)*math.Pow(2, float64(attempt))))
+			if err := sleep(ctx, backoff); err != nil {
+				return nil, err
+			}
+
+			lastErr = fmt.Errorf("server error: %d", resp.StatusCode)
+
+			continue
+		default:
+			return resp, nil
+		}
+	}
+
+	return nil, fmt.Errorf("giving up after %d attempts: %w", maxRetries+1, lastErr)
+}
+
+func (c *Client) waitForBucket(ctx context.Context, key string) error {
+	c.bucketsMu.Lock()
+	b, ok := c.byRoute[key]
+	c.bucketsMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	b.mu.Lock()
+	wait := time.Until(b.reset)
+	remaining := b.remaining
+	b.mu.Unlock()
+
+	if remaining > 0 || wait <= 0 {
+		return nil
+	}
+
+	return sleep(ctx, wait)
+}
+
+func (c *Client) waitForGlobal(ctx context.Context) error {
+	c.globalMu.Lock()
+	wait := time.Until(c.globalGate)
+	c.globalMu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	return sleep(ctx, wait)
+}
+
+func (c *Client) setGlobalGate(d time.Duration) {
+	c.globalMu.Lock()
+	defer c.globalMu.Unlock()
+
+	c.globalGate = time.Now().Add(d)
+}
+
+func (c *Client) updateBucket(key string, header http.Header) {
+	bucketID := header.Get("X-RateLimit-Bucket")
+	if bucketID == "" {
+		return
+	}
+
+	remaining, _ := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	resetAfter, _ := strconv.ParseFloat(header.Get("X-RateLimit-Reset-After"), 64)
+
+	c.bucketsMu.Lock()
+	b, ok := c.buckets[bucketID]
+	if !ok {
+		b = &bucket{id: bucketID}
+		c.buckets[bucketID] = b
+	}
+	c.byRoute[key] = b
+	c.bucketsMu.Unlock()
+
+	b.mu.Lock()
+	b.remaining = remaining
+	b.reset = time.Now().Add(time.Duration(resetAfter * float64(time.Second)))
+	b.mu.Unlock()
+}
+
+func parseRetryAfter(header string) time.Duration {
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		return time.Second
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,392 @@
+// Package remoteauth implements Discord's "remote auth" QR-login handshake:
+// the same protocol the official mobile app uses to approve a new login by
+// scanning a QR code shown on the desktop/web client.
+//
+// The handshake runs over a dedicated gateway, independent of the normal
+// Discord gateway:
+//
+//  1. hello                 - server sends a heartbeat interval
+//  2. init                  - client sends its RSA public key
+//  3. nonce_proof            - server sends an encrypted nonce, client proves
+//     it holds the private key by returning a hash of the decrypted nonce
+//  4. pending_remote_init    - server sends a fingerprint; this becomes the
+//     QR code the user scans with their phone
+//  5. pending_ticket         - once scanned, server sends the pending user's
+//     encrypted profile
+//  6. pending_login          - once approved on the phone, server sends a
+//     ticket that's exchanged over REST for the final encrypted token
+//  7. finish / cancel        - the handshake concludes, or the user declines
+//     on their phone
+package remoteauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const gatewayURL = "wss://remote-auth-gateway.discord.gg/?v=2"
+
+// EventType identifies one step of the remote-auth handshake, emitted on
+// the events channel passed to Client.Dial so callers can surface granular
+// login progress instead of just a final success/error.
+type EventType string
+
+const (
+	EventFingerprint EventType = "fingerprint"
+	EventUserInfo    EventType = "userinfo"
+	EventToken       EventType = "token"
+)
+
+// Event is one intermediate remote-auth event.
+type Event struct {
+	Type EventType
+
+	// Fingerprint is set for EventFingerprint; it's the same value encoded
+	// into the QR code.
+	Fingerprint string
+
+	// User is set for EventUserInfo, once the phone has scanned the code.
+	User *PendingUser
+
+	// UserID is set for EventToken, once the phone has approved the login
+	// and the ticket has been exchanged for a token.
+	UserID string
+}
+
+// PendingUser is the profile Discord sends once the QR code has been
+// scanned, before the user has approved the login on their phone.
+type PendingUser struct {
+	ID            string
+	Discriminator string
+	Avatar        string
+	Username      string
+}
+
+// User is the final result of a successful handshake.
+type User struct {
+	UserID string
+	Token  string
+}
+
+type wsFrame struct {
+	Op   string          `json:"op"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Client runs one remote-auth handshake. It is not safe for concurrent use
+// beyond the Dial/Result pair it's designed for.
+type Client struct {
+	privateKey *rsa.PrivateKey
+	conn       *websocket.Conn
+
+	mu     sync.Mutex
+	result *User
+	err    error
+	done   bool
+}
+
+// New generates the RSA keypair used to prove ownership of the QR code and
+// decrypt the payloads Discord sends back over the course of the handshake.
+func New() (*Client, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate keypair: %w", err)
+	}
+
+	return &Client{privateKey: key}, nil
+}
+
+// Dial connects to the remote-auth gateway and starts the handshake in the
+// background. Progress is reported on events (intermediate steps), qrChan
+// (the fingerprint to render as a QR code), and doneChan (closed once the
+// handshake concludes, successfully or not - check Result() afterwards).
+// Sending on cancel tells the server the client gave up.
+func (c *Client) Dial(ctx context.Context, events chan<- Event, qrChan chan<- string, doneChan chan<- struct{}, cancel <-chan struct{}) error {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, gatewayURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect to remote auth gateway: %w", err)
+	}
+
+	c.conn = conn
+
+	go c.run(ctx, events, qrChan, doneChan, cancel)
+
+	return nil
+}
+
+// Result returns the final user/token once doneChan has been closed.
+func (c *Client) Result() (*User, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	if c.result == nil {
+		return nil, fmt.Errorf("handshake did not produce a result")
+	}
+
+	return c.result, nil
+}
+
+func (c *Client) run(ctx context.Context, events chan<- Event, qrChan chan<- string, doneChan chan<- struct{}, cancel <-chan struct{}) {
+	defer close(doneChan)
+	defer c.conn.Close()
+
+	finished := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-cancel:
+			_ = c.conn.WriteJSON(wsFrame{Op: "cancel"})
+		case <-finished:
+		}
+	}()
+	defer close(finished)
+
+	var heartbeat *time.Ticker
+	defer func() {
+		if heartbeat != nil {
+			heartbeat.Stop()
+		}
+	}()
+
+	for {
+		var frame wsFrame
+		if err := c.conn.ReadJSON(&frame); err != nil {
+			c.fail(fmt.Errorf("remote auth gateway closed: %w", err))
+			return
+		}
+
+		switch frame.Op {
+		case "hello":
+			var hello struct {
+				HeartbeatInterval int `json:"heartbeat_interval"`
+			}
+			if err := json.Unmarshal(frame.Data, &hello); err != nil {
+				c.fail(fmt.Errorf("failed to decode hello: %w", err))
+				return
+			}
+
+			heartbeat = time.NewTicker(time.Duration(hello.HeartbeatInterval) * time.Millisecond)
+			go c.heartbeatLoop(heartbeat, finished)
+
+			if err := c.sendInit(); err != nil {
+				c.fail(err)
+				return
+			}
+		case "nonce_proof":
+			var payload struct {
+				EncryptedNonce string `json:"encrypted_nonce"`
+			}
+			if err := json.Unmarshal(frame.Data, &payload); err != nil {
+				c.fail(fmt.Errorf("failed to decode nonce_proof: %w", err))
+				return
+			}
+
+			if err := c.proveNonce(payload.EncryptedNonce); err != nil {
+				c.fail(err)
+				return
+			}
+		case "pending_remote_init":
+			var payload struct {
+				Fingerprint string `json:"fingerprint"`
+			}
+			if err := json.Unmarshal(frame.Data, &payload); err != nil {
+				c.fail(fmt.Errorf("failed to decode pending_remote_init: %w", err))
+				return
+			}
+
+			qrChan <- payload.Fingerprint
+			events <- Event{Type: EventFingerprint, Fingerprint: payload.Fingerprint}
+		case "pending_ticket":
+			var payload struct {
+				EncryptedUserPayload string `json:"encrypted_user_payload"`
+			}
+			if err := json.Unmarshal(frame.Data, &payload); err != nil {
+				c.fail(fmt.Errorf("failed to decode pending_ticket: %w", err))
+				return
+			}
+
+			user, err := c.decryptPendingUser(payload.EncryptedUserPayload)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+
+			events <- Event{Type: EventUserInfo, User: user}
+		case "pending_login":
+			var payload struct {
+				Ticket string `json:"ticket"`
+			}
+			if err := json.Unmarshal(frame.Data, &payload); err != nil {
+				c.fail(fmt.Errorf("failed to decode pending_login: %w", err))
+				return
+			}
+
+			token, userID, err := c.exchangeTicket(ctx, payload.Ticket)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+
+			events <- Event{Type: EventToken, UserID: userID}
+
+			c.mu.Lock()
+			c.result = &User{UserID: userID, Token: token}
+			c.mu.Unlock()
+
+			return
+		case "cancel":
+			c.fail(fmt.Errorf("login was cancelled from the phone"))
+			return
+		}
+	}
+}
+
+func (c *Client) heartbeatLoop(ticker *time.Ticker, stop <-chan struct{}) {
+	for {
+		select {
+		case <-ticker.C:
+			_ = c.conn.WriteJSON(wsFrame{Op: "heartbeat"})
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *Client) sendInit() error {
+	publicKey, err := x509.MarshalPKIXPublicKey(&c.privateKey.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to marshal public key: %w", err)
+	}
+
+	return c.conn.WriteJSON(wsFrame{
+		Op:   "init",
+		Data: mustJSON(map[string]string{"encoded_public_key": base64.StdEncoding.EncodeToString(publicKey)}),
+	})
+}
+
+func (c *Client) proveNonce(encryptedNonce string) error {
+	raw, err := base64.StdEncoding.DecodeString(encryptedNonce)
+	if err != nil {
+		return fmt.Errorf("failed to decode nonce: %w", err)
+	}
+
+	nonce, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, c.privateKey, raw, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt nonce: %w", err)
+	}
+
+	sum := sha256.Sum256(nonce)
+	proof := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return c.conn.WriteJSON(wsFrame{
+		Op:   "nonce_proof",
+		Data: mustJSON(map[string]string{"proof": proof}),
+	})
+}
+
+func (c *Client) decrypt(encrypted string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode payload: %w", err)
+	}
+
+	plain, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, c.privateKey, raw, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload: %w", err)
+	}
+
+	return plain, nil
+}
+
+// decryptPendingUser decodes the colon-delimited "id:discriminator:avatar:username"
+// profile Discord sends once the QR code has been scanned.
+func (c *Client) decryptPendingUser(encrypted string) (*PendingUser, error) {
+	plain, err := c.decrypt(encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(string(plain), ":", 4)
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("malformed pending user payload")
+	}
+
+	return &PendingUser{ID: parts[0], Discriminator: parts[1], Avatar: parts[2], Username: parts[3]}, nil
+}
+
+// exchangeTicket trades the ticket the phone approved for the real user
+// token over REST, then decrypts it with our private key.
+func (c *Client) exchangeTicket(ctx context.Context, ticket string) (token, userID string, err error) {
+	body, err := json.Marshal(map[string]string{"ticket": ticket})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode ticket request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://discord.com/api/v9/users/@me/remote-auth/login", bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to exchange ticket: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("discord returned status %d exchanging ticket", resp.StatusCode)
+	}
+
+	var respBody struct {
+		EncryptedToken string `json:"encrypted_token"`
+		UserID         string `json:"user_id"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return "", "", fmt.Errorf("failed to decode ticket exchange response: %w", err)
+	}
+
+	plainToken, err := c.decrypt(respBody.EncryptedToken)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(plainToken), respBody.UserID, nil
+}
+
+func mustJSON(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}